@@ -0,0 +1,35 @@
+package wallet
+
+import "testing"
+
+// TestEncryptWithPassphraseRoundTrip checks that decryptWithPassphrase
+// reverses encryptWithPassphrase given the same passphrase, and rejects the
+// blob outright when given the wrong one.
+func TestEncryptWithPassphraseRoundTrip(t *testing.T) {
+	plaintext := []byte("a seed worth protecting")
+
+	blob, err := encryptWithPassphrase("correct horse", plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted, err := decryptWithPassphrase("correct horse", blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != string(plaintext) {
+		t.Fatalf("decrypted plaintext %q does not match original %q", decrypted, plaintext)
+	}
+
+	if _, err := decryptWithPassphrase("wrong passphrase", blob); err != ErrWrongPassphrase {
+		t.Fatalf("expected ErrWrongPassphrase for an incorrect passphrase, got %v", err)
+	}
+}
+
+// TestDecryptWithPassphraseShortBlob checks that a blob too short to contain
+// even a salt is rejected instead of panicking on a slice out-of-range.
+func TestDecryptWithPassphraseShortBlob(t *testing.T) {
+	if _, err := decryptWithPassphrase("anything", []byte("short")); err == nil {
+		t.Fatal("expected an error for a blob shorter than the salt size")
+	}
+}
@@ -0,0 +1,412 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"github.com/NebulousLabs/Andromeda/consensus"
+	"github.com/NebulousLabs/Andromeda/signatures"
+)
+
+// ErrWalletLocked is returned by any call that needs secret key material -
+// CoinAddress, FundTransaction, or anything that signs - while the wallet
+// is locked.
+var ErrWalletLocked = errors.New("wallet is locked")
+
+// persistedAddress is the on-disk mirror of spendableAddress. spendableAddress's
+// fields are unexported, so gob can't encode it directly.
+type persistedAddress struct {
+	SpendConditions consensus.SpendConditions
+	SecretKey       signatures.SecretKey
+}
+
+// persistedOutput is the on-disk mirror of trackedOutput.
+type persistedOutput struct {
+	Output consensus.Output
+	Owner  consensus.CoinAddress
+}
+
+// persistedTransactionMeta is the on-disk mirror of transactionMeta.
+// transactionMeta's fields are unexported, so gob can't encode it directly.
+type persistedTransactionMeta struct {
+	Label     string
+	Purpose   TransactionPurpose
+	Timestamp int64
+}
+
+// persistedState is everything OpenEncrypted needs to reconstruct a
+// Wallet's keychain, output set, and transaction labels from disk.
+type persistedState struct {
+	Seed               *Seed
+	SeedIndex          uint64
+	SpendableAddresses map[consensus.CoinAddress]persistedAddress
+	Outputs            map[consensus.OutputID]persistedOutput
+	OwnedOutputs       map[consensus.OutputID]struct{}
+	SpentOutputs       map[consensus.OutputID]struct{}
+	Meta               map[consensus.TransactionID]persistedTransactionMeta
+}
+
+// The on-disk wallet file is:
+//
+//	uint32 LE length of the wrapped master key
+//	wrapped master key (encryptWithPassphrase(passphrase, masterKey))
+//	nonce || ChaCha20-Poly1305(masterKey, persistedState gob)
+//
+// Wrapping the master key separately from the state is what lets
+// ChangePassphrase re-wrap it without touching the ciphertext of the
+// records themselves.
+const masterKeySize = chacha20poly1305.KeySize
+
+func writeWalletFile(path string, wrappedMasterKey, encryptedState []byte) error {
+	var header [4]byte
+	binary.LittleEndian.PutUint32(header[:], uint32(len(wrappedMasterKey)))
+
+	var buf bytes.Buffer
+	buf.Write(header[:])
+	buf.Write(wrappedMasterKey)
+	buf.Write(encryptedState)
+
+	// Write to a temp file and rename over the destination so a crash
+	// mid-write can never leave a half-written wallet file behind.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readWalletFile(path string) (wrappedMasterKey, encryptedState []byte, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) < 4 {
+		return nil, nil, errors.New("wallet file is corrupt")
+	}
+	wrappedLen := binary.LittleEndian.Uint32(data[:4])
+	rest := data[4:]
+	if uint32(len(rest)) < wrappedLen {
+		return nil, nil, errors.New("wallet file is corrupt")
+	}
+	return rest[:wrappedLen], rest[wrappedLen:], nil
+}
+
+func encryptState(masterKey []byte, state persistedState) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(state); err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.New(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nil, nonce, buf.Bytes(), nil)
+	return append(nonce, sealed...), nil
+}
+
+func decryptState(masterKey, encryptedState []byte) (persistedState, error) {
+	var state persistedState
+	aead, err := chacha20poly1305.New(masterKey)
+	if err != nil {
+		return state, err
+	}
+	if len(encryptedState) < aead.NonceSize() {
+		return state, errors.New("wallet file is corrupt")
+	}
+	nonce, ciphertext := encryptedState[:aead.NonceSize()], encryptedState[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return state, ErrWrongPassphrase
+	}
+	if err := gob.NewDecoder(bytes.NewReader(plaintext)).Decode(&state); err != nil {
+		return state, err
+	}
+	return state, nil
+}
+
+// snapshot captures the wallet's current keychain and output set for
+// persisting to disk. Callers must hold w.mu.
+func (w *Wallet) snapshot() persistedState {
+	addrs := make(map[consensus.CoinAddress]persistedAddress, len(w.spendableAddresses))
+	for addr, sa := range w.spendableAddresses {
+		addrs[addr] = persistedAddress{SpendConditions: *sa.spendConditions, SecretKey: sa.secretKey}
+	}
+
+	outputs := make(map[consensus.OutputID]persistedOutput, len(w.outputs))
+	for id, tracked := range w.outputs {
+		outputs[id] = persistedOutput{Output: tracked.output, Owner: tracked.owner}
+	}
+
+	var seed *Seed
+	if w.seed != nil {
+		s := *w.seed
+		seed = &s
+	}
+
+	w.meta.Lock()
+	meta := make(map[consensus.TransactionID]persistedTransactionMeta, len(w.meta.byID))
+	for id, m := range w.meta.byID {
+		meta[id] = persistedTransactionMeta{Label: m.label, Purpose: m.purpose, Timestamp: m.timestamp}
+	}
+	w.meta.Unlock()
+
+	return persistedState{
+		Seed:               seed,
+		SeedIndex:          w.seedIndex,
+		SpendableAddresses: addrs,
+		Outputs:            outputs,
+		OwnedOutputs:       w.ownedOutputs,
+		SpentOutputs:       w.spentOutputs,
+		Meta:               meta,
+	}
+}
+
+// restore repopulates the wallet's in-memory keychain and output set from a
+// decrypted persistedState. Callers must hold w.mu.
+func (w *Wallet) restore(state persistedState) {
+	w.seed = state.Seed
+	w.seedIndex = state.SeedIndex
+
+	w.spendableAddresses = make(map[consensus.CoinAddress]*spendableAddress, len(state.SpendableAddresses))
+	for addr, pa := range state.SpendableAddresses {
+		spendConditions := pa.SpendConditions
+		w.spendableAddresses[addr] = &spendableAddress{
+			spendConditions: &spendConditions,
+			secretKey:       pa.SecretKey,
+		}
+	}
+
+	w.outputs = make(map[consensus.OutputID]*trackedOutput, len(state.Outputs))
+	for id, po := range state.Outputs {
+		w.outputs[id] = &trackedOutput{output: po.Output, owner: po.Owner}
+	}
+
+	w.ownedOutputs = state.OwnedOutputs
+	if w.ownedOutputs == nil {
+		w.ownedOutputs = make(map[consensus.OutputID]struct{})
+	}
+	w.spentOutputs = state.SpentOutputs
+	if w.spentOutputs == nil {
+		w.spentOutputs = make(map[consensus.OutputID]struct{})
+	}
+
+	// Outputs carry their own value, so restoring from disk can recompute
+	// the balance directly instead of trusting a persisted number that
+	// could drift out of sync with the output set.
+	var balance consensus.Currency
+	for id := range w.ownedOutputs {
+		balance += w.outputs[id].output.Value
+	}
+	w.balance = balance
+
+	w.meta.Lock()
+	w.meta.byID = make(map[consensus.TransactionID]*transactionMeta, len(state.Meta))
+	for id, pm := range state.Meta {
+		w.meta.byID[id] = &transactionMeta{label: pm.Label, purpose: pm.Purpose, timestamp: pm.Timestamp}
+	}
+	w.meta.Unlock()
+}
+
+// persist writes the wallet's current state to disk under its existing
+// master key, leaving the wrapped master key untouched. It is called after
+// every Update, so a crash never loses more than the in-flight block. It is
+// a no-op for wallets that weren't opened with OpenEncrypted or
+// CreateEncrypted. Callers must hold w.mu.
+func (w *Wallet) persist() error {
+	if w.persistPath == "" {
+		return nil
+	}
+	if w.locked {
+		return ErrWalletLocked
+	}
+
+	wrappedMasterKey, _, err := readWalletFile(w.persistPath)
+	if err != nil {
+		return err
+	}
+	encryptedState, err := encryptState(w.masterKey, w.snapshot())
+	if err != nil {
+		return err
+	}
+	return writeWalletFile(w.persistPath, wrappedMasterKey, encryptedState)
+}
+
+// CreateEncrypted creates a brand new Wallet and writes it to path,
+// encrypted under passphrase. path must not already exist.
+func CreateEncrypted(path, passphrase string) (*Wallet, error) {
+	if _, err := os.Stat(path); err == nil {
+		return nil, errors.New("a wallet file already exists at that path")
+	}
+
+	seed, err := NewSeed()
+	if err != nil {
+		return nil, err
+	}
+	w, err := NewFromSeed(seed)
+	if err != nil {
+		return nil, err
+	}
+
+	masterKey := make([]byte, masterKeySize)
+	if _, err := rand.Read(masterKey); err != nil {
+		return nil, err
+	}
+	wrappedMasterKey, err := encryptWithPassphrase(passphrase, masterKey)
+	if err != nil {
+		return nil, err
+	}
+	encryptedState, err := encryptState(masterKey, w.snapshot())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := writeWalletFile(path, wrappedMasterKey, encryptedState); err != nil {
+		return nil, err
+	}
+
+	w.persistPath = path
+	w.masterKey = masterKey
+	return w, nil
+}
+
+// OpenEncrypted opens the wallet previously written to path by
+// CreateEncrypted, decrypting it with passphrase.
+func OpenEncrypted(path, passphrase string) (*Wallet, error) {
+	wrappedMasterKey, encryptedState, err := readWalletFile(path)
+	if err != nil {
+		return nil, err
+	}
+	masterKey, err := decryptWithPassphrase(passphrase, wrappedMasterKey)
+	if err != nil {
+		return nil, err
+	}
+	state, err := decryptState(masterKey, encryptedState)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := New()
+	if err != nil {
+		return nil, err
+	}
+	w.mu.Lock()
+	w.restore(state)
+	w.persistPath = path
+	w.masterKey = masterKey
+	w.mu.Unlock()
+	return w, nil
+}
+
+// Lock persists the wallet's current state, then zeroes out every secret
+// key it's holding in memory, including the root seed of an HD wallet: a
+// live seed can regenerate every private key ever handed out, so it needs
+// zeroing as much as any single spendableAddress's secretKey does.
+// CoinAddress, FundTransaction, and any other call that needs to sign fail
+// with ErrWalletLocked until Unlock is called.
+// Lock refuses to run on a wallet that wasn't opened with OpenEncrypted or
+// CreateEncrypted, since such a wallet has no on-disk copy to recover its
+// keys from afterward - zeroing them would destroy them permanently.
+func (w *Wallet) Lock() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.persistPath == "" {
+		return errors.New("wallet was not opened from an encrypted file")
+	}
+
+	// Persist first: anything produced since the last block-triggered
+	// persist, most importantly CoinAddress's advance of seedIndex, would
+	// otherwise be lost and re-handed-out by Unlock, risking address
+	// reuse.
+	if err := w.persist(); err != nil {
+		return err
+	}
+
+	for _, sa := range w.spendableAddresses {
+		sa.secretKey = signatures.SecretKey{}
+	}
+	if w.seed != nil {
+		for i := range w.seed {
+			w.seed[i] = 0
+		}
+		w.seed = nil
+	}
+	for i := range w.masterKey {
+		w.masterKey[i] = 0
+	}
+	w.masterKey = nil
+	w.locked = true
+	return nil
+}
+
+// Unlock decrypts the wallet's on-disk state with passphrase and restores
+// secret key material to memory.
+func (w *Wallet) Unlock(passphrase string) error {
+	w.mu.RLock()
+	path := w.persistPath
+	w.mu.RUnlock()
+	if path == "" {
+		return errors.New("wallet was not opened from an encrypted file")
+	}
+
+	wrappedMasterKey, encryptedState, err := readWalletFile(path)
+	if err != nil {
+		return err
+	}
+	masterKey, err := decryptWithPassphrase(passphrase, wrappedMasterKey)
+	if err != nil {
+		return err
+	}
+	state, err := decryptState(masterKey, encryptedState)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.restore(state)
+	w.masterKey = masterKey
+	w.locked = false
+	return nil
+}
+
+// ChangePassphrase re-wraps the wallet's master key under newPassphrase,
+// without re-encrypting the underlying records: the ciphertext written by
+// the most recent persist is untouched.
+func (w *Wallet) ChangePassphrase(oldPassphrase, newPassphrase string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.locked {
+		return ErrWalletLocked
+	}
+
+	wrappedMasterKey, encryptedState, err := readWalletFile(w.persistPath)
+	if err != nil {
+		return err
+	}
+	if _, err := decryptWithPassphrase(oldPassphrase, wrappedMasterKey); err != nil {
+		return err
+	}
+
+	newWrappedMasterKey, err := encryptWithPassphrase(newPassphrase, w.masterKey)
+	if err != nil {
+		return err
+	}
+	return writeWalletFile(w.persistPath, newWrappedMasterKey, encryptedState)
+}
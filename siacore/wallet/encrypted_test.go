@@ -0,0 +1,78 @@
+package wallet
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestCreateOpenEncryptedRoundTrip checks that a wallet's address (and thus
+// its underlying seed) survives a CreateEncrypted/OpenEncrypted round trip.
+func TestCreateOpenEncryptedRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wallet.dat")
+
+	w, err := CreateEncrypted(path, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := w.CoinAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opened, err := OpenEncrypted(path, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopenedAddr := deriveSpendableAddress(*opened.seed, 0).spendConditions.CoinAddress()
+	if reopenedAddr != addr {
+		t.Fatal("reopened wallet did not derive the same first address as the original")
+	}
+
+	if _, err := OpenEncrypted(path, "wrong passphrase"); err == nil {
+		t.Fatal("expected OpenEncrypted to reject the wrong passphrase")
+	}
+}
+
+// TestLockUnencryptedWallet checks that Lock refuses to zero the keys of a
+// plain in-memory wallet, since there's no on-disk copy to recover them from
+// afterward.
+func TestLockUnencryptedWallet(t *testing.T) {
+	w, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Lock(); err == nil {
+		t.Fatal("expected Lock to refuse a wallet that wasn't opened from an encrypted file")
+	}
+}
+
+// TestLockPersistsBeforeZeroing checks that Lock persists the current
+// seedIndex before zeroing in-memory key material, so a subsequent Unlock
+// doesn't hand out an address that was already given out before Lock.
+func TestLockPersistsBeforeZeroing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wallet.dat")
+
+	w, err := CreateEncrypted(path, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := w.CoinAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Unlock("correct horse"); err != nil {
+		t.Fatal(err)
+	}
+
+	nextAddr, err := w.CoinAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nextAddr == addr {
+		t.Fatal("Unlock handed out an address that was already given out before Lock")
+	}
+}
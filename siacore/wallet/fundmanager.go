@@ -0,0 +1,241 @@
+package wallet
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/NebulousLabs/Andromeda/consensus"
+)
+
+// ReservationID identifies a single reservation made against a FundManager.
+type ReservationID uint64
+
+// reservationState is the lifecycle of a single reservation: reserved while
+// a caller is still building a transaction against it, committed once that
+// transaction has been broadcast, and finally completed once the
+// transaction is seen on chain. released covers a caller backing out before
+// ever broadcasting.
+type reservationState int
+
+const (
+	reservationReserved reservationState = iota
+	reservationCommitted
+	reservationReleased
+	reservationCompleted
+)
+
+// reservation is a single caller's claim on amount of an address's funds.
+// It exists purely as bookkeeping: it records no outputs. Which outputs
+// fund it is decided by Wallet.reserveInputs, which marks them in the
+// wallet's spentOutputs right after Reserve succeeds.
+type reservation struct {
+	id     ReservationID
+	addr   consensus.CoinAddress
+	amount consensus.Currency
+	state  reservationState
+	txn    *consensus.Transaction // set once Commit is called
+}
+
+// active reports whether the reservation still counts against an address's
+// available balance.
+func (r *reservation) active() bool {
+	return r.state == reservationReserved || r.state == reservationCommitted
+}
+
+// addressQueue serializes every reservation made against a single address
+// through one mutex, so two goroutines funding transactions against the
+// same address can never reserve the same coins twice.
+type addressQueue struct {
+	sync.Mutex
+	reservations []*reservation
+}
+
+// FundManager sits between callers and a Wallet's output set. It tracks the
+// lifetime of every amount a caller has reserved against an address for a
+// not-yet-broadcast transaction: a reservation that's released stops
+// counting against the address's available balance immediately. It does
+// not track which outputs fund a reservation and never changes the
+// wallet's spentOutputs; that is left to the Wallet. This is modeled on
+// the fund-manager pattern used by Lotus's market actor.
+type FundManager struct {
+	wallet *Wallet
+
+	mu           sync.Mutex
+	nextID       ReservationID
+	reservations map[ReservationID]*reservation
+	queues       map[consensus.CoinAddress]*addressQueue
+}
+
+// NewFundManager creates a FundManager backed by w's output set.
+func NewFundManager(w *Wallet) *FundManager {
+	return &FundManager{
+		wallet:       w,
+		reservations: make(map[ReservationID]*reservation),
+		queues:       make(map[consensus.CoinAddress]*addressQueue),
+	}
+}
+
+// queueFor returns the addressQueue for addr, creating it if this is the
+// first reservation ever made against addr.
+func (fm *FundManager) queueFor(addr consensus.CoinAddress) *addressQueue {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	q, exists := fm.queues[addr]
+	if !exists {
+		q = &addressQueue{}
+		fm.queues[addr] = q
+	}
+	return q
+}
+
+// reservedAgainst sums the amount of every active (reserved or committed)
+// reservation against addr. Callers must hold q's lock.
+func reservedAgainst(q *addressQueue) (total consensus.Currency) {
+	for _, r := range q.reservations {
+		if r.active() {
+			total += r.amount
+		}
+	}
+	return
+}
+
+// Available returns addr's own balance minus the amount locked up by active
+// reservations against it. Released and completed reservations don't
+// count, so a refund or a confirmed spend immediately frees up capacity
+// for the next caller.
+func (fm *FundManager) Available(addr consensus.CoinAddress) (consensus.Currency, error) {
+	total := fm.wallet.addressBalance(addr)
+
+	q := fm.queueFor(addr)
+	q.Lock()
+	defer q.Unlock()
+	reserved := reservedAgainst(q)
+	if reserved > total {
+		return 0, nil
+	}
+	return total - reserved, nil
+}
+
+// Reserve claims amount of addr's available balance on behalf of a caller
+// who is about to build a transaction. The claim is purely bookkeeping: no
+// outputs are touched here. Outputs are selected separately for each
+// reservation by the caller; reservations pending against the same addr
+// are not coalesced into a single top-up transaction.
+func (fm *FundManager) Reserve(addr consensus.CoinAddress, amount consensus.Currency) (ReservationID, error) {
+	if amount == 0 {
+		return 0, errors.New("cannot reserve 0 coins")
+	}
+
+	q := fm.queueFor(addr)
+	q.Lock()
+	defer q.Unlock()
+
+	available := fm.wallet.addressBalance(addr)
+	if reserved := reservedAgainst(q); reserved+amount > available {
+		return 0, errors.New("insufficient available funds for reservation")
+	}
+
+	fm.mu.Lock()
+	fm.nextID++
+	id := fm.nextID
+	r := &reservation{id: id, addr: addr, amount: amount, state: reservationReserved}
+	fm.reservations[id] = r
+	fm.mu.Unlock()
+
+	q.reservations = append(q.reservations, r)
+	return id, nil
+}
+
+// Release frees up a reservation's claim on its address's available
+// balance. It is a no-op if id has already completed.
+func (fm *FundManager) Release(id ReservationID) error {
+	fm.mu.Lock()
+	r, exists := fm.reservations[id]
+	fm.mu.Unlock()
+	if !exists {
+		return errors.New("no reservation with that id")
+	}
+
+	q := fm.queueFor(r.addr)
+	q.Lock()
+	defer q.Unlock()
+	if r.state == reservationCompleted {
+		return nil
+	}
+	r.state = reservationReleased
+	return nil
+}
+
+// Commit marks a reservation's funding transaction as broadcast. Wallet's
+// FundTransaction calls this once it has finished assembling txn, so that
+// OnBlock knows which on-chain transaction to watch for.
+func (fm *FundManager) Commit(id ReservationID, txn *consensus.Transaction) error {
+	fm.mu.Lock()
+	r, exists := fm.reservations[id]
+	fm.mu.Unlock()
+	if !exists {
+		return errors.New("no reservation with that id")
+	}
+
+	q := fm.queueFor(r.addr)
+	q.Lock()
+	defer q.Unlock()
+	r.txn = txn
+	r.state = reservationCommitted
+	return nil
+}
+
+// OnBlock scans every transaction in applied for a committed reservation's
+// funding transaction, and marks it completed once that transaction
+// appears in an applied block. Completed reservations stop counting against their address's
+// available balance, same as released ones.
+func (fm *FundManager) OnBlock(applied []consensus.Block) {
+	fm.mu.Lock()
+	inFlight := make([]*reservation, 0, len(fm.reservations))
+	for _, r := range fm.reservations {
+		if r.state == reservationCommitted {
+			inFlight = append(inFlight, r)
+		}
+	}
+	fm.mu.Unlock()
+	if len(inFlight) == 0 {
+		return
+	}
+
+	for _, b := range applied {
+		for _, t := range b.Transactions {
+			for _, r := range inFlight {
+				if r.state == reservationCompleted || r.txn == nil {
+					continue
+				}
+				if sameTransaction(r.txn, &t) {
+					q := fm.queueFor(r.addr)
+					q.Lock()
+					r.state = reservationCompleted
+					q.Unlock()
+				}
+			}
+		}
+	}
+}
+
+// sameTransaction reports whether a and b have the same inputs and
+// outputs, which is enough to recognize a reservation's funding
+// transaction once it's mined, without the wallet package needing a
+// canonical transaction ID.
+func sameTransaction(a, b *consensus.Transaction) bool {
+	if len(a.Inputs) != len(b.Inputs) || len(a.Outputs) != len(b.Outputs) {
+		return false
+	}
+	for i := range a.Inputs {
+		if a.Inputs[i].OutputID != b.Inputs[i].OutputID {
+			return false
+		}
+	}
+	for i := range a.Outputs {
+		if a.Outputs[i] != b.Outputs[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,324 @@
+package wallet
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/NebulousLabs/Andromeda/consensus"
+	"github.com/NebulousLabs/Andromeda/signatures"
+)
+
+// JointReservationID identifies a single collaborative transaction
+// negotiation tracked by a Wallet.
+type JointReservationID uint64
+
+// jointState tracks where a JointReservation is in the handshake: funded
+// locally, waiting on the counterparty's contribution, waiting on their
+// signatures, finalized, or canceled. This mirrors the stages lnd's
+// ChannelReservation goes through before a channel funding transaction is
+// broadcast.
+type jointState int
+
+const (
+	jointNegotiating jointState = iota
+	jointAwaitingSignatures
+	jointFinalized
+	jointCanceled
+)
+
+// JointConstraints are the terms a counterparty proposes for a joint
+// transaction. ContributeFunds rejects a counterparty contribution that
+// violates them, so such a transaction never reaches CommitSignatures.
+type JointConstraints struct {
+	MinFee        consensus.Currency
+	DustThreshold consensus.Currency
+	MaxInputs     int
+}
+
+// JointSignature is one party's signature over a single input of a joint
+// transaction. CommitSignatures verifies one of these per input the
+// counterparty is responsible for before finalizing.
+type JointSignature struct {
+	InputIndex uint64
+	PublicKey  signatures.PublicKey
+	Signature  signatures.Signature
+}
+
+// JointReservation is a transaction being collaboratively assembled by two
+// or more wallets. It survives Update and Reset unmodified; a re-org during
+// negotiation only matters once CommitSignatures re-validates our inputs
+// are still ours to spend.
+type JointReservation struct {
+	id              JointReservationID
+	ourReservation  ReservationID
+	ourContribution consensus.Currency
+	theirPubKey     signatures.PublicKey
+	constraints     JointConstraints
+
+	transaction     *consensus.Transaction
+	ourInputs       []uint64 // indices into transaction.Inputs that are ours
+	theirSignatures []JointSignature
+	state           jointState
+}
+
+// jointTransactions stores every in-progress JointReservation, keyed by ID.
+// It lives alongside the rest of a Wallet's state but is never touched by
+// Update or Reset, so the handshake can't be corrupted by a chain reorg -
+// only explicitly invalidated, at CommitSignatures time.
+type jointTransactions struct {
+	sync.Mutex
+	nextID       JointReservationID
+	reservations map[JointReservationID]*JointReservation
+}
+
+func newJointTransactions() *jointTransactions {
+	return &jointTransactions{
+		reservations: make(map[JointReservationID]*JointReservation),
+	}
+}
+
+// InitJoint begins a collaborative transaction: it reserves ourContribution
+// from the wallet's own funds via FundManager, attaches a refund output for
+// any change, and returns a JointReservationID the caller threads through
+// ContributeFunds and CommitSignatures as the counterparty responds.
+func (w *Wallet) InitJoint(ourContribution consensus.Currency, theirPubKey signatures.PublicKey, constraints JointConstraints) (JointReservationID, error) {
+	if ourContribution == 0 {
+		return 0, errors.New("cannot joint-fund 0 coins")
+	}
+
+	resID, inputs, refund, err := w.reserveInputs(ourContribution)
+	if err != nil {
+		return 0, err
+	}
+
+	t := &consensus.Transaction{Inputs: inputs}
+	ourInputs := make([]uint64, len(inputs))
+	for i := range inputs {
+		ourInputs[i] = uint64(i)
+	}
+	if refund != nil {
+		t.Outputs = append(t.Outputs, *refund)
+	}
+
+	jr := &JointReservation{
+		ourReservation:  resID,
+		ourContribution: ourContribution,
+		theirPubKey:     theirPubKey,
+		constraints:     constraints,
+		transaction:     t,
+		ourInputs:       ourInputs,
+		state:           jointNegotiating,
+	}
+
+	w.joints.Lock()
+	defer w.joints.Unlock()
+	w.joints.nextID++
+	jr.id = w.joints.nextID
+	w.joints.reservations[jr.id] = jr
+	return jr.id, nil
+}
+
+// ContributeFunds merges the counterparty's inputs, outputs, and miner fees
+// from remoteTx into the reservation's draft transaction. It rejects
+// remoteTx outright if it would violate the constraints negotiated in
+// InitJoint.
+func (w *Wallet) ContributeFunds(id JointReservationID, remoteTx *consensus.Transaction) error {
+	jr, err := w.joint(id)
+	if err != nil {
+		return err
+	}
+	if jr.state != jointNegotiating {
+		return errors.New("joint reservation is not accepting contributions")
+	}
+
+	if err := jr.validateContribution(remoteTx); err != nil {
+		return err
+	}
+
+	t := jr.transaction
+	t.Inputs = append(t.Inputs, remoteTx.Inputs...)
+	t.Outputs = append(t.Outputs, remoteTx.Outputs...)
+	t.MinerFees = append(t.MinerFees, remoteTx.MinerFees...)
+	jr.state = jointAwaitingSignatures
+	return nil
+}
+
+// validateContribution checks remoteTx against jr's negotiated constraints.
+func (jr *JointReservation) validateContribution(remoteTx *consensus.Transaction) error {
+	if jr.constraints.MaxInputs > 0 && len(jr.transaction.Inputs)+len(remoteTx.Inputs) > jr.constraints.MaxInputs {
+		return errors.New("counterparty contributed more inputs than the negotiated max")
+	}
+	for _, fee := range remoteTx.MinerFees {
+		if fee < jr.constraints.MinFee {
+			return errors.New("counterparty's miner fee is below the negotiated minimum")
+		}
+	}
+	for _, output := range remoteTx.Outputs {
+		if output.Value < jr.constraints.DustThreshold {
+			return errors.New("counterparty contributed a dust output")
+		}
+	}
+	return nil
+}
+
+// CommitSignatures verifies the counterparty's signatures over the inputs
+// they own, and, once they're all valid, returns the fully signed
+// transaction. It re-checks that our own inputs are still unspent first, so
+// a reorg that invalidated them during negotiation is caught here instead
+// of producing an invalid transaction.
+func (w *Wallet) CommitSignatures(id JointReservationID, remoteSigs []JointSignature) (*consensus.Transaction, error) {
+	jr, err := w.joint(id)
+	if err != nil {
+		return nil, err
+	}
+	if jr.state != jointAwaitingSignatures {
+		return nil, errors.New("joint reservation is not ready for signatures")
+	}
+
+	numInputs := uint64(len(jr.transaction.Inputs))
+	for _, sig := range remoteSigs {
+		if sig.InputIndex >= numInputs {
+			return nil, errors.New("signature references an input index that doesn't exist")
+		}
+	}
+
+	// Every input that isn't one of ours is the counterparty's, and needs a
+	// signature in remoteSigs before this transaction can be finalized.
+	// Without this check, a counterparty that simply omits a signature for
+	// one of their own inputs still gets the reservation committed and
+	// tracked, leaving it stuck forever with no way to release it.
+	ourInputSet := make(map[uint64]struct{}, len(jr.ourInputs))
+	for _, idx := range jr.ourInputs {
+		ourInputSet[idx] = struct{}{}
+	}
+	signedSet := make(map[uint64]struct{}, len(remoteSigs))
+	for _, sig := range remoteSigs {
+		signedSet[sig.InputIndex] = struct{}{}
+	}
+	for idx := uint64(0); idx < numInputs; idx++ {
+		if _, ours := ourInputSet[idx]; ours {
+			continue
+		}
+		if _, signed := signedSet[idx]; !signed {
+			return nil, errors.New("counterparty did not supply a signature for one of their inputs")
+		}
+	}
+
+	w.mu.RLock()
+	for _, idx := range jr.ourInputs {
+		input := jr.transaction.Inputs[idx]
+		if _, owned := w.ownedOutputs[input.OutputID]; !owned {
+			w.mu.RUnlock()
+			return nil, errors.New("one of our inputs was spent elsewhere during negotiation")
+		}
+	}
+	w.mu.RUnlock()
+
+	for _, sig := range remoteSigs {
+		if sig.PublicKey != jr.theirPubKey {
+			return nil, errors.New("signature is not from the expected counterparty")
+		}
+		if !signatures.VerifyBytes(sig.PublicKey, jr.transaction.SigHash(sig.InputIndex), sig.Signature) {
+			return nil, errors.New("counterparty signature failed verification")
+		}
+	}
+
+	// Sign our own inputs with the secret key of whichever address owns
+	// each one, then merge them with the counterparty's now-verified
+	// signatures onto the transaction. Without this, jr.transaction would
+	// be returned with no signatures on any input at all.
+	w.mu.RLock()
+	if w.locked {
+		w.mu.RUnlock()
+		return nil, ErrWalletLocked
+	}
+	ourSigs := make([]JointSignature, len(jr.ourInputs))
+	for i, idx := range jr.ourInputs {
+		input := jr.transaction.Inputs[idx]
+		sa, exists := w.spendableAddresses[input.SpendConditions.CoinAddress()]
+		if !exists {
+			w.mu.RUnlock()
+			return nil, errors.New("no secret key for one of our own inputs")
+		}
+		sig, serr := signatures.SignBytes(sa.secretKey, jr.transaction.SigHash(idx))
+		if serr != nil {
+			w.mu.RUnlock()
+			return nil, serr
+		}
+		ourSigs[i] = JointSignature{InputIndex: idx, PublicKey: sa.spendConditions.PublicKeys[0], Signature: sig}
+	}
+	w.mu.RUnlock()
+
+	jr.transaction.Signatures = make([]consensus.TransactionSignature, 0, len(ourSigs)+len(remoteSigs))
+	for _, sig := range append(ourSigs, remoteSigs...) {
+		jr.transaction.Signatures = append(jr.transaction.Signatures, consensus.TransactionSignature{
+			InputID:        jr.transaction.Inputs[sig.InputIndex].OutputID,
+			PublicKeyIndex: 0,
+			Signature:      sig.Signature,
+		})
+	}
+
+	jr.theirSignatures = remoteSigs
+	jr.state = jointFinalized
+
+	if err := w.fundManager.Commit(jr.ourReservation, jr.transaction); err != nil {
+		return nil, err
+	}
+
+	// Track the finalized transaction the same way a single-wallet
+	// transaction is tracked, so it shows up in ListTransactions and can be
+	// labeled like any other.
+	w.mu.Lock()
+	txnID := strconv.Itoa(w.transactionCounter)
+	w.transactionCounter++
+	w.transactions[txnID] = &openTransaction{
+		transaction: jr.transaction,
+		inputs:      jr.ourInputs,
+		purpose:     PurposeJointReservation,
+		timestamp:   time.Now().Unix(),
+	}
+	w.mu.Unlock()
+
+	return jr.transaction, nil
+}
+
+// Cancel unwinds a JointReservation, releasing our contribution back to the
+// fund manager so it's immediately available for another transaction.
+func (w *Wallet) Cancel(id JointReservationID) error {
+	jr, err := w.joint(id)
+	if err != nil {
+		return err
+	}
+	if jr.state == jointFinalized {
+		return errors.New("cannot cancel a joint reservation that already finalized")
+	}
+
+	if err := w.fundManager.Release(jr.ourReservation); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	for _, idx := range jr.ourInputs {
+		delete(w.spentOutputs, jr.transaction.Inputs[idx].OutputID)
+	}
+	w.mu.Unlock()
+
+	w.joints.Lock()
+	jr.state = jointCanceled
+	delete(w.joints.reservations, id)
+	w.joints.Unlock()
+	return nil
+}
+
+// joint looks up a JointReservation by ID.
+func (w *Wallet) joint(id JointReservationID) (*JointReservation, error) {
+	w.joints.Lock()
+	defer w.joints.Unlock()
+	jr, exists := w.joints.reservations[id]
+	if !exists {
+		return nil, errors.New("no joint reservation with that id")
+	}
+	return jr, nil
+}
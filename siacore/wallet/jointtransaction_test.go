@@ -0,0 +1,98 @@
+package wallet
+
+import (
+	"testing"
+
+	"github.com/NebulousLabs/Andromeda/consensus"
+	"github.com/NebulousLabs/Andromeda/signatures"
+)
+
+// fundedTestWallet returns a Wallet with a single owned output of amount
+// paying its own address, without going through Update.
+func fundedTestWallet(t *testing.T, amount consensus.Currency) *Wallet {
+	w, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := w.CoinAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var outputID consensus.OutputID
+	outputID[0] = 1
+	w.outputs[outputID] = &trackedOutput{output: consensus.Output{Value: amount, SpendHash: addr}, owner: addr}
+	w.ownedOutputs[outputID] = struct{}{}
+	w.balance = amount
+	return w
+}
+
+// TestCommitSignaturesRejectsBadSignature checks that CommitSignatures
+// refuses to finalize a joint transaction when a "counterparty" signature
+// doesn't actually verify against the negotiated counterparty public key.
+func TestCommitSignaturesRejectsBadSignature(t *testing.T) {
+	w := fundedTestWallet(t, 100)
+
+	_, theirPub, err := signatures.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := w.InitJoint(100, theirPub, JointConstraints{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.ContributeFunds(id, &consensus.Transaction{}); err != nil {
+		t.Fatal(err)
+	}
+
+	jr, err := w.joint(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sign with a key other than the one the counterparty actually
+	// negotiated with, so the claimed signature doesn't verify.
+	otherSK, _, err := signatures.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	badSig, err := signatures.SignBytes(otherSK, jr.transaction.SigHash(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.CommitSignatures(id, []JointSignature{{InputIndex: 0, PublicKey: theirPub, Signature: badSig}})
+	if err == nil {
+		t.Fatal("expected CommitSignatures to reject a signature that doesn't verify")
+	}
+}
+
+// TestCommitSignaturesRequiresEveryCounterpartyInput checks that
+// CommitSignatures refuses to finalize a joint transaction if the
+// counterparty omits a signature for one of the inputs they contributed.
+func TestCommitSignaturesRequiresEveryCounterpartyInput(t *testing.T) {
+	w := fundedTestWallet(t, 100)
+
+	_, theirPub, err := signatures.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := w.InitJoint(100, theirPub, JointConstraints{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The counterparty contributes one input of their own, which they then
+	// fail to sign below.
+	remoteTx := &consensus.Transaction{Inputs: []consensus.Input{{}}}
+	if err := w.ContributeFunds(id, remoteTx); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.CommitSignatures(id, nil)
+	if err == nil {
+		t.Fatal("expected CommitSignatures to reject a transaction missing a signature for the counterparty's input")
+	}
+}
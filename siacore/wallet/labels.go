@@ -0,0 +1,187 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/NebulousLabs/Andromeda/consensus"
+)
+
+// TransactionPurpose classifies why a wallet-tracked transaction exists, so
+// it can be sorted into buckets after the fact without the caller having to
+// re-derive intent from raw inputs and outputs.
+type TransactionPurpose int
+
+const (
+	PurposeSend TransactionPurpose = iota
+	PurposeRefund
+	PurposeContractFunding
+	PurposeJointReservation
+	PurposeMinerReward
+)
+
+// maxLabelLength caps how much free-form text LabelTransaction will accept.
+const maxLabelLength = 256
+
+// transactionMeta is the structured metadata a Wallet keeps for a
+// confirmed transaction, keyed by consensus.TransactionID rather than the
+// ephemeral counter-string openTransaction uses while a transaction is
+// still being built. Keying by the final transaction ID, instead of the
+// counter, is what lets a label survive confirmation and a restart.
+type transactionMeta struct {
+	label     string
+	purpose   TransactionPurpose
+	timestamp int64
+}
+
+// metaStore holds transactionMeta for every confirmed transaction a Wallet
+// has labeled or recognized.
+type metaStore struct {
+	sync.Mutex
+	byID map[consensus.TransactionID]*transactionMeta
+}
+
+func newMetaStore() *metaStore {
+	return &metaStore{byID: make(map[consensus.TransactionID]*transactionMeta)}
+}
+
+// TransactionInfo is what ListTransactions and TransactionsByLabel return
+// about a single transaction: its metadata, the inputs the wallet itself
+// contributed, and whether it's been confirmed yet. Inputs is filled in
+// only for open transactions; a confirmed one carries no input indices.
+type TransactionInfo struct {
+	ID        consensus.TransactionID
+	Label     string
+	Purpose   TransactionPurpose
+	Timestamp int64
+	Inputs    []uint64
+	Confirmed bool
+}
+
+// TransactionFilter narrows down ListTransactions. The zero value matches
+// everything.
+type TransactionFilter struct {
+	LabelPrefix   string
+	ConfirmedOnly bool
+}
+
+// matches reports whether info satisfies f.
+func (f TransactionFilter) matches(info TransactionInfo) bool {
+	if f.ConfirmedOnly && !info.Confirmed {
+		return false
+	}
+	return strings.HasPrefix(info.Label, f.LabelPrefix)
+}
+
+// LabelTransaction attaches a free-form label to a transaction. id may be
+// either the counter-string of a still-open transaction (RegisterTransaction's
+// return value) or the hex-encoded consensus.TransactionID of a transaction
+// that's already confirmed. A label is immutable once set to a non-empty
+// value, so accounting built from it stays stable even if the transaction
+// is labeled again by mistake.
+func (w *Wallet) LabelTransaction(id string, label string) error {
+	if len(label) > maxLabelLength {
+		return fmt.Errorf("label exceeds %v bytes", maxLabelLength)
+	}
+
+	w.mu.Lock()
+	ot, isOpen := w.transactions[id]
+	w.mu.Unlock()
+
+	if isOpen {
+		if ot.label != "" {
+			return errors.New("label is already set and cannot be changed")
+		}
+		ot.label = label
+		return nil
+	}
+
+	var tid consensus.TransactionID
+	if err := tid.LoadString(id); err != nil {
+		return fmt.Errorf("%q is not an open transaction or a transaction id", id)
+	}
+
+	w.meta.Lock()
+	defer w.meta.Unlock()
+	m, exists := w.meta.byID[tid]
+	if !exists {
+		return errors.New("no confirmed transaction with that id")
+	}
+	if m.label != "" {
+		return errors.New("label is already set and cannot be changed")
+	}
+	m.label = label
+	return nil
+}
+
+// promoteConfirmed snapshots an open transaction's metadata into w.meta
+// once it's been seen confirmed on chain, keyed by its final transaction
+// ID, then removes it from w.transactions: once a transaction lives in
+// w.meta, keeping its open-counter entry around would make it show up
+// twice in ListTransactions (once unconfirmed, once confirmed) and leak
+// memory for every transaction the wallet ever sends. Callers must hold
+// w's lock.
+func (w *Wallet) promoteConfirmed(t *consensus.Transaction) {
+	for counterID, ot := range w.transactions {
+		if !sameTransaction(ot.transaction, t) {
+			continue
+		}
+		w.meta.Lock()
+		w.meta.byID[t.ID()] = &transactionMeta{
+			label:     ot.label,
+			purpose:   ot.purpose,
+			timestamp: ot.timestamp,
+		}
+		w.meta.Unlock()
+		delete(w.transactions, counterID)
+		return
+	}
+}
+
+// TransactionsByLabel returns every transaction whose label begins with
+// prefix, open or confirmed.
+func (w *Wallet) TransactionsByLabel(prefix string) []TransactionInfo {
+	return w.ListTransactions(TransactionFilter{LabelPrefix: prefix})
+}
+
+// ListTransactions returns every transaction matching filter, both open and
+// confirmed, with its metadata. Open transactions also carry the input
+// indices the wallet contributed; confirmed ones do not.
+func (w *Wallet) ListTransactions(filter TransactionFilter) []TransactionInfo {
+	var results []TransactionInfo
+
+	w.mu.RLock()
+	for _, ot := range w.transactions {
+		info := TransactionInfo{
+			ID:        ot.transaction.ID(),
+			Label:     ot.label,
+			Purpose:   ot.purpose,
+			Timestamp: ot.timestamp,
+			Inputs:    ot.inputs,
+			Confirmed: false,
+		}
+		if filter.matches(info) {
+			results = append(results, info)
+		}
+	}
+	w.mu.RUnlock()
+
+	w.meta.Lock()
+	for tid, m := range w.meta.byID {
+		info := TransactionInfo{
+			ID:        tid,
+			Label:     m.label,
+			Purpose:   m.purpose,
+			Timestamp: m.timestamp,
+			Confirmed: true,
+		}
+		if filter.matches(info) {
+			results = append(results, info)
+		}
+	}
+	w.meta.Unlock()
+
+	return results
+}
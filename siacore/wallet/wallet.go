@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/NebulousLabs/Andromeda/consensus"
 	"github.com/NebulousLabs/Andromeda/signatures"
@@ -15,6 +16,16 @@ import (
 type openTransaction struct {
 	transaction *consensus.Transaction
 	inputs      []uint64
+
+	// label, purpose, and timestamp are the structured metadata exposed
+	// through LabelTransaction and ListTransactions. They live here while
+	// the transaction is still open because its content, and therefore its
+	// consensus.TransactionID, keeps changing as inputs and outputs are
+	// added; promoteConfirmed snapshots them into the by-ID metaStore once
+	// the transaction is seen confirmed and its ID is final.
+	label     string
+	purpose   TransactionPurpose
+	timestamp int64
 }
 
 // openOutput contains an output and the conditions needed to spend the output,
@@ -25,6 +36,17 @@ type spendableAddress struct {
 	secretKey       signatures.SecretKey
 }
 
+// trackedOutput is everything the wallet remembers about a single output it
+// has ever seen pay one of its own addresses: the output itself, and which
+// address owns it. Update and reserveInputs both look an output up here
+// rather than carrying its value and owner out of band, which is what lets
+// reserveInputs restrict a transaction to inputs that actually share one
+// address's spend conditions.
+type trackedOutput struct {
+	output consensus.Output
+	owner  consensus.CoinAddress
+}
+
 // Wallet holds your coins, manages privacy, outputs, ect. The balance reported
 // by the wallet does not include coins that you have spent in transactions yet
 // haven't been revealed in a block.
@@ -35,48 +57,116 @@ type spendableAddress struct {
 // things that need to do the lookups. (and type consensus.State would
 // implement the interface fulfilling that abstraction)
 type Wallet struct {
-	balance            consensus.Currency
-	ownedOutputs       map[consensus.CoinAddress]struct{}
-	spentOutputs       map[consensus.CoinAddress]struct{}
+	balance consensus.Currency
+
+	// outputs is the wallet's memory of every output it has ever seen pay
+	// one of its own addresses, keyed by OutputID. ownedOutputs is the
+	// subset of those keys that are still unspent on chain; spentOutputs is
+	// the subset that have been claimed as inputs to an outgoing
+	// transaction (by FundTransaction or a JointReservation) but not yet
+	// seen confirmed, so reserveInputs knows not to select them again.
+	outputs            map[consensus.OutputID]*trackedOutput
+	ownedOutputs       map[consensus.OutputID]struct{}
+	spentOutputs       map[consensus.OutputID]struct{}
 	spendableAddresses map[consensus.CoinAddress]*spendableAddress
 
+	// seed is nil for wallets created with New(), which still generate a
+	// fresh random keypair per address the way the wallet always has. Once
+	// a wallet has a seed, CoinAddress derives every address as seed's
+	// child at seedIndex instead. seedIndex is kept in memory only for now;
+	// it starts surviving a restart once the wallet is opened through
+	// OpenEncrypted.
+	seed      *Seed
+	seedIndex uint64
+
+	// fundManager tracks, per address, how much of its balance is reserved
+	// for a not-yet-broadcast transaction. FundTransaction and InitJoint
+	// reserve through it. Cancel returns a joint reservation's outputs to
+	// selection; FundTransaction commits its reservation at once and does
+	// not return its ID, so its outputs stay in spentOutputs until they are
+	// seen spent on chain or Reset runs.
+	fundManager *FundManager
+
+	// joints tracks in-progress multi-party transactions. It is deliberately
+	// kept separate from the rest of Wallet's state: Update and Reset never
+	// touch it, so a reorg mid-negotiation can't corrupt a JointReservation
+	// out from under the handshake.
+	joints *jointTransactions
+
+	// meta holds the structured metadata (label, purpose, timestamp) for
+	// every transaction the wallet had open (registered or joint) and has
+	// since seen confirmed, keyed by its final consensus.TransactionID so
+	// labels persist across restart and survive the transaction moving from
+	// open to confirmed. A confirmed transaction the wallet never had open,
+	// such as one paying it from outside, gets no entry.
+	meta *metaStore
+
 	transactionCounter int
 	transactions       map[string]*openTransaction
 
-	sync.RWMutex
+	// mu is a named field, rather than an embedded sync.RWMutex, because
+	// Wallet also exposes Lock()/Unlock(passphrase) as its public
+	// passphrase-lock API (see encrypted.go); embedding would have the
+	// mutex's methods silently shadow those.
+	mu sync.RWMutex
+
+	// persistPath, masterKey, and locked back the encrypted on-disk store
+	// opened by OpenEncrypted/CreateEncrypted. persistPath is empty for a
+	// plain in-memory wallet created with New(), in which case persist,
+	// Lock, and Unlock are all no-ops/errors.
+	persistPath string
+	masterKey   []byte
+	locked      bool
 }
 
 // New creates an initializes a Wallet.
 func New() (*Wallet, error) {
-	return &Wallet{
-		ownedOutputs:       make(map[consensus.CoinAddress]struct{}),
-		spentOutputs:       make(map[consensus.CoinAddress]struct{}),
+	w := &Wallet{
+		outputs:            make(map[consensus.OutputID]*trackedOutput),
+		ownedOutputs:       make(map[consensus.OutputID]struct{}),
+		spentOutputs:       make(map[consensus.OutputID]struct{}),
 		spendableAddresses: make(map[consensus.CoinAddress]*spendableAddress),
 		transactions:       make(map[string]*openTransaction),
-	}, nil
+	}
+	w.fundManager = NewFundManager(w)
+	w.joints = newJointTransactions()
+	w.meta = newMetaStore()
+	return w, nil
 }
 
-// Update implements the core.Wallet interface.
+// Update implements the core.Wallet interface. It is called on every new
+// block, so every lookup here goes through w.spendableAddresses rather than
+// a single implicit address: an HD wallet (see seed.go) hands out many
+// addresses, and an output can pay any one of them.
 func (w *Wallet) Update(rewound []consensus.Block, applied []consensus.Block) error {
-	w.Lock()
-	defer w.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-	// Remove all of the owned outputs created in the rewound blocks. Do not
-	// change the spent outputs map.
+	// Remove all of the owned outputs created in the rewound blocks, and put
+	// back the balance and ownership of whatever they spent. Do not change
+	// the spent outputs map: a reservation made against an output that
+	// survives the reorg is still valid.
 	for _, b := range rewound {
 		for i := len(b.Transactions) - 1; i >= 0; i-- {
-			// Remove all outputs that got created by this block.
-			for j, _ := range b.Transactions[i].Outputs {
+			for j := range b.Transactions[i].Outputs {
 				id := b.Transactions[i].OutputID(j)
-				delete(w.ownedOutputs, id)
+				if _, owned := w.ownedOutputs[id]; owned {
+					w.balance -= w.outputs[id].output.Value
+					delete(w.ownedOutputs, id)
+				}
+				delete(w.outputs, id)
 			}
 
-			// Re-add all inputs that got consumed by this block.
 			for _, input := range b.Transactions[i].Inputs {
-				if ca == input.SpendConditions.CoinAddress() {
-					w.balance += w.outputs[input.OutputID].output.Value
-					w.ownedOutputs[input.OutputID] = struct{}{}
+				tracked, exists := w.outputs[input.OutputID]
+				if !exists {
+					continue
+				}
+				if _, owned := w.spendableAddresses[tracked.owner]; !owned {
+					continue
 				}
+				w.balance += tracked.output.Value
+				w.ownedOutputs[input.OutputID] = struct{}{}
 			}
 		}
 	}
@@ -87,28 +177,45 @@ func (w *Wallet) Update(rewound []consensus.Block, applied []consensus.Block) er
 		for _, t := range b.Transactions {
 			// Remove all the outputs that got consumed by this block.
 			for _, input := range t.Inputs {
-				delete(w.ownedOutputs, input.OutputID)
+				if _, owned := w.ownedOutputs[input.OutputID]; owned {
+					w.balance -= w.outputs[input.OutputID].output.Value
+					delete(w.ownedOutputs, input.OutputID)
+				}
+				delete(w.spentOutputs, input.OutputID)
 			}
 
-			// Add all of the outputs that got created by this block.
+			// Add all of the outputs that got created by this block and pay
+			// one of our addresses.
 			for i, output := range t.Outputs {
-				if ca == output.SpendHash {
-					id := t.OutputID(i)
-					w.ownedOutputs[id] = struct{}{}
-					w.outputs[id].output = &output
-					w.balance += output.Value
+				if _, owned := w.spendableAddresses[output.SpendHash]; !owned {
+					continue
 				}
+				id := t.OutputID(i)
+				w.outputs[id] = &trackedOutput{output: output, owner: output.SpendHash}
+				w.ownedOutputs[id] = struct{}{}
+				w.balance += output.Value
 			}
+
+			w.promoteConfirmed(&t)
 		}
 	}
 
+	w.fundManager.OnBlock(applied)
+
+	// A locked wallet can't write its new state to disk, but every lookup
+	// above already succeeded in memory; Update implements core.Wallet and
+	// runs on every block, so a caller that treats a non-nil return as
+	// fatal must not be made to desync just because persist couldn't run.
+	if err := w.persist(); err != nil && err != ErrWalletLocked {
+		return err
+	}
 	return nil
 }
 
 // Reset implements the core.Wallet interface.
 func (w *Wallet) Reset() error {
-	w.Lock()
-	defer w.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
 	for id := range w.spentOutputs {
 		// Add the spent output back into the balance if it's currently an
@@ -123,107 +230,235 @@ func (w *Wallet) Reset() error {
 
 // Balance implements the core.Wallet interface.
 func (w *Wallet) Balance() (consensus.Currency, error) {
-	w.RLock()
-	defer w.RUnlock()
+	w.mu.RLock()
+	defer w.mu.RUnlock()
 	return w.balance, nil
 }
 
-// CoinAddress implements the core.Wallet interface.
+// addressBalance sums the value of every currently-unspent output owned by
+// addr, as opposed to Balance's wallet-wide total. FundManager caps a
+// reservation against this instead of Balance, since a reservation can only
+// ever be funded out of the one address it was made against.
+func (w *Wallet) addressBalance(addr consensus.CoinAddress) consensus.Currency {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	var total consensus.Currency
+	for outputID := range w.ownedOutputs {
+		tracked, exists := w.outputs[outputID]
+		if !exists || tracked.owner != addr {
+			continue
+		}
+		total += tracked.output.Value
+	}
+	return total
+}
+
+// FundManager returns the FundManager tracking w's reservations.
+func (w *Wallet) FundManager() *FundManager {
+	return w.fundManager
+}
+
+// CoinAddress implements the core.Wallet interface. If the wallet was
+// created from a seed (NewFromSeed, RestoreFromSeed), the address is the
+// next unused child in the HD keychain; otherwise a fresh random keypair is
+// generated, as CoinAddress has always done.
 func (w *Wallet) CoinAddress() (coinAddress consensus.CoinAddress, err error) {
-	sk, pk, err := signatures.GenerateKeyPair()
-	if err != nil {
-		return
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.locked {
+		return consensus.CoinAddress{}, ErrWalletLocked
 	}
+	return w.nextAddress()
+}
 
-	newSpendableAddress := &spendableAddress{
-		spendConditions: consensus.SpendConditions{
-			NumSignatures: 1,
-			PublicKeys:    []signatures.PublicKey{pk},
-		},
-		secretKey: sk,
+// nextAddress hands out the next address in the wallet's keychain. Callers
+// must hold w's lock.
+func (w *Wallet) nextAddress() (coinAddress consensus.CoinAddress, err error) {
+	var newSpendableAddress *spendableAddress
+	if w.seed != nil {
+		newSpendableAddress = deriveSpendableAddress(*w.seed, w.seedIndex)
+		w.seedIndex++
+	} else {
+		sk, pk, kerr := signatures.GenerateKeyPair()
+		if kerr != nil {
+			err = kerr
+			return
+		}
+		newSpendableAddress = &spendableAddress{
+			spendConditions: &consensus.SpendConditions{
+				NumSignatures: 1,
+				PublicKeys:    []signatures.PublicKey{pk},
+			},
+			secretKey: sk,
+		}
 	}
 
-	coinAddress = newAddress.spendConditions.CoinAddress()
+	coinAddress = newSpendableAddress.spendConditions.CoinAddress()
 	w.spendableAddresses[coinAddress] = newSpendableAddress
 	return
 }
 
 // RegisterTransaction implements the core.Wallet interface.
 func (w *Wallet) RegisterTransaction(t *consensus.Transaction) (id string, err error) {
-	w.Lock()
-	defer w.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
 	id = strconv.Itoa(w.transactionCounter)
 	w.transactionCounter++
-	w.transactions[id].transaction = t
+	w.transactions[id] = &openTransaction{
+		transaction: t,
+		purpose:     PurposeSend,
+		timestamp:   time.Now().Unix(),
+	}
 	return
 }
 
-// FundTransaction implements the core.Wallet interface.
-func (w *Wallet) FundTransaction(id string, amount consensus.Currency) error {
-	if amount == consensus.Currency(0) {
-		return errors.New("cannot fund 0 coins") // should this be an error or nil?
-	}
-	ot, exists := w.transactions[id]
-	if !exists {
-		return errors.New("no transaction of given id found")
+// reserveInputs selects enough outputs from a single spendableAddress to
+// cover amount, reserving them against w.fundManager and marking them in
+// w.spentOutputs so no later call selects them again. It does not commit
+// the reservation: callers that go through with the transaction must call
+// w.fundManager.Commit on the returned ReservationID, and callers that back
+// out must call w.fundManager.Release and take the inputs back out of
+// w.spentOutputs, as Cancel does. This split is what lets InitJoint hold a
+// reservation open across a multi-party handshake instead of committing it
+// the instant funds are found, the way a single-wallet FundTransaction can.
+func (w *Wallet) reserveInputs(amount consensus.Currency) (resID ReservationID, inputs []consensus.Input, refund *consensus.Output, err error) {
+	w.mu.RLock()
+	if w.locked {
+		w.mu.RUnlock()
+		err = ErrWalletLocked
+		return
 	}
-	t := ot.transaction
 
-	total := consensus.Currency(0)
-	var newInputs []consensus.Input
-	for id, _ := range w.ownedOutputs {
-		// Check if we've already spent the output.
-		_, exists := w.spentOutputs[id]
-		if exists {
+	// Group our currently-unspent, unreserved outputs by the address that
+	// owns them. Every input in a transaction must share that one
+	// address's spend conditions, so a transaction can only be funded out
+	// of a single address's outputs at a time.
+	byAddress := make(map[consensus.CoinAddress][]consensus.OutputID)
+	addrTotals := make(map[consensus.CoinAddress]consensus.Currency)
+	for outputID := range w.ownedOutputs {
+		if _, reserved := w.spentOutputs[outputID]; reserved {
+			continue
+		}
+		owner := w.outputs[outputID].owner
+		byAddress[owner] = append(byAddress[owner], outputID)
+		addrTotals[owner] += w.outputs[outputID].output.Value
+	}
+	w.mu.RUnlock()
+
+	// w.fundManager takes its own lock on w to look up each candidate's
+	// balance, so none of this loop may hold w.mu: doing so would deadlock
+	// the moment Available or Reserve called back in.
+	var fundingAddress consensus.CoinAddress
+	var fundingOutputs []consensus.OutputID
+	found := false
+	for candidate, outputIDs := range byAddress {
+		if addrTotals[candidate] < amount {
 			continue
 		}
 
-		// Fetch the output
-		output := w.outputs[id].output
-
-		// Create an input for the transaction
-		newInput := consensus.Input{
-			OutputID:        id,
-			SpendConditions: w.spendConditions,
+		available, aerr := w.fundManager.Available(candidate)
+		if aerr != nil {
+			err = aerr
+			return
 		}
-		newInputs = append(newInputs, newInput)
+		if available < amount {
+			continue
+		}
+		resID, err = w.fundManager.Reserve(candidate, amount)
+		if err != nil {
+			continue
+		}
+		fundingAddress, fundingOutputs, found = candidate, outputIDs, true
+		break
+	}
+	if !found {
+		err = fmt.Errorf("insufficient funds: no single address has %v available", amount)
+		return
+	}
+
+	w.mu.Lock()
+	spendConditions := w.spendableAddresses[fundingAddress].spendConditions
+	total := consensus.Currency(0)
+	for _, outputID := range fundingOutputs {
+		output := w.outputs[outputID].output
+		inputs = append(inputs, consensus.Input{
+			OutputID:        outputID,
+			SpendConditions: *spendConditions,
+		})
 
-		// See if the value of the inputs has surpassed `amount`.
 		total += output.Value
 		if total >= amount {
 			break
 		}
 	}
 
-	// Check that enough inputs were added.
 	if total < amount {
-		return fmt.Errorf("insufficient funds, requested %v but only have %v", amount, total)
+		w.mu.Unlock()
+		w.fundManager.Release(resID)
+		err = fmt.Errorf("insufficient funds, requested %v but only have %v", amount, total)
+		return
 	}
 
-	// Add the inputs to the transaction.
-	t.Inputs = append(t.Inputs, newInputs...)
-	for _, input := range newInputs {
-		ot.inputs = append(ot.inputs, uint64(len(t.Inputs)))
+	for _, input := range inputs {
 		w.spentOutputs[input.OutputID] = struct{}{}
 	}
 
-	// Add a refund output if needed.
 	if total-amount > 0 {
-		t.Outputs = append(
-			t.Outputs,
-			consensus.Output{
-				Value:     total - amount,
-				SpendHash: w.spendConditions.CoinAddress(),
-			},
-		)
+		var refundAddress consensus.CoinAddress
+		refundAddress, err = w.nextAddress()
+		if err != nil {
+			w.mu.Unlock()
+			w.fundManager.Release(resID)
+			return
+		}
+		refund = &consensus.Output{Value: total - amount, SpendHash: refundAddress}
 	}
+	w.mu.Unlock()
 
-	return nil
+	return
+}
+
+// FundTransaction implements the core.Wallet interface. It reserves amount
+// through w.fundManager and commits the reservation as soon as the inputs
+// are attached to t. The reservation's ID is not returned, so the caller
+// cannot release it; the selected outputs stay in spentOutputs until they
+// are seen spent on chain or Reset runs.
+func (w *Wallet) FundTransaction(id string, amount consensus.Currency) error {
+	if amount == consensus.Currency(0) {
+		return errors.New("cannot fund 0 coins") // should this be an error or nil?
+	}
+	w.mu.Lock()
+	ot, exists := w.transactions[id]
+	w.mu.Unlock()
+	if !exists {
+		return errors.New("no transaction of given id found")
+	}
+	t := ot.transaction
+
+	resID, newInputs, refund, err := w.reserveInputs(amount)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	start := uint64(len(t.Inputs))
+	t.Inputs = append(t.Inputs, newInputs...)
+	for i := range newInputs {
+		ot.inputs = append(ot.inputs, start+uint64(i))
+	}
+	if refund != nil {
+		t.Outputs = append(t.Outputs, *refund)
+	}
+	w.mu.Unlock()
+
+	return w.fundManager.Commit(resID, t)
 }
 
 // AddMinerFee implements the core.Wallet interface.
 func (w *Wallet) AddMinerFee(id string, fee consensus.Currency) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 	to, exists := w.transactions[id]
 	if !exists {
 		return errors.New("no transaction found for given id")
@@ -235,6 +470,8 @@ func (w *Wallet) AddMinerFee(id string, fee consensus.Currency) error {
 
 // AddOutput implements the core.Wallet interface.
 func (w *Wallet) AddOutput(id string, amount consensus.Currency, dest consensus.CoinAddress) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 	to, exists := w.transactions[id]
 	if !exists {
 		return errors.New("no transaction found for given id")
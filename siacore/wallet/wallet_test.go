@@ -0,0 +1,86 @@
+package wallet
+
+import (
+	"testing"
+
+	"github.com/NebulousLabs/Andromeda/consensus"
+)
+
+// TestUpdateRewindsCreatedOutput checks that rewinding a block that created
+// an owned output removes it from both the balance and ownedOutputs, the
+// same way applying that block added it in the first place.
+func TestUpdateRewindsCreatedOutput(t *testing.T) {
+	w, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := w.CoinAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txn := consensus.Transaction{
+		Outputs: []consensus.Output{{Value: 100, SpendHash: addr}},
+	}
+	block := consensus.Block{Transactions: []consensus.Transaction{txn}}
+
+	if err := w.Update(nil, []consensus.Block{block}); err != nil {
+		t.Fatal(err)
+	}
+	if balance, _ := w.Balance(); balance != 100 {
+		t.Fatalf("expected balance of 100 after applying the block, got %v", balance)
+	}
+
+	if err := w.Update([]consensus.Block{block}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if balance, _ := w.Balance(); balance != 0 {
+		t.Fatalf("expected balance of 0 after rewinding the block that created it, got %v", balance)
+	}
+	if len(w.ownedOutputs) != 0 {
+		t.Fatalf("expected no owned outputs after rewind, got %v", len(w.ownedOutputs))
+	}
+}
+
+// TestUpdateRewindsSpentInput checks that rewinding a block that spent an
+// owned output restores both its balance and its ownedOutputs entry.
+func TestUpdateRewindsSpentInput(t *testing.T) {
+	w, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := w.CoinAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fundingTxn := consensus.Transaction{
+		Outputs: []consensus.Output{{Value: 100, SpendHash: addr}},
+	}
+	fundingBlock := consensus.Block{Transactions: []consensus.Transaction{fundingTxn}}
+	if err := w.Update(nil, []consensus.Block{fundingBlock}); err != nil {
+		t.Fatal(err)
+	}
+
+	outputID := fundingTxn.OutputID(0)
+	spendingTxn := consensus.Transaction{
+		Inputs: []consensus.Input{{OutputID: outputID}},
+	}
+	spendingBlock := consensus.Block{Transactions: []consensus.Transaction{spendingTxn}}
+	if err := w.Update(nil, []consensus.Block{spendingBlock}); err != nil {
+		t.Fatal(err)
+	}
+	if balance, _ := w.Balance(); balance != 0 {
+		t.Fatalf("expected balance of 0 after spending the output, got %v", balance)
+	}
+
+	if err := w.Update([]consensus.Block{spendingBlock}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if balance, _ := w.Balance(); balance != 100 {
+		t.Fatalf("expected balance of 100 restored after rewinding the block that spent it, got %v", balance)
+	}
+	if _, owned := w.ownedOutputs[outputID]; !owned {
+		t.Fatal("expected the spent output to be owned again after rewind")
+	}
+}